@@ -0,0 +1,230 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/golang/glog"
+	"golang.org/x/tools/cover"
+)
+
+// lineRange is an inclusive range of changed line numbers in a file's new (head) revision.
+type lineRange struct {
+	start, end int
+}
+
+// hunkHeader matches a unified diff hunk header, e.g. "@@ -10,0 +11,3 @@".
+var hunkHeader = regexp.MustCompile(`^@@ -\d+(?:,\d+)? \+(\d+)(?:,(\d+))? @@`)
+
+// gitDiffLines shells out to `git diff --unified=0` between base and head and returns, per file,
+// the line ranges added or modified in head. It uses git's three-dot range syntax, diffing
+// against the merge-base of base and head rather than base's tip, so commits that landed on base
+// after head branched off don't pollute the changed-line set. -diff_base must therefore name a
+// commit that head's branch actually forked from (an ancestor of -diff_head, in the common case).
+func gitDiffLines(base, head string) (map[string][]lineRange, error) {
+	out, err := exec.Command("git", "diff", "--unified=0", fmt.Sprintf("%s...%s", base, head)).Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to run git diff %s...%s, %v", base, head, err)
+	}
+	return parseUnifiedDiff(out)
+}
+
+// parseUnifiedDiff extracts the added/modified line ranges of each file touched by a
+// `git diff --unified=0` output.
+func parseUnifiedDiff(diff []byte) (map[string][]lineRange, error) {
+	changed := make(map[string][]lineRange)
+
+	var currentFile string
+	var prevWasMinusHeader bool
+	scanner := bufio.NewScanner(bytes.NewReader(diff))
+	for scanner.Scan() {
+		line := scanner.Text()
+		isMinusHeader := strings.HasPrefix(line, "--- ")
+		wasMinusHeader := prevWasMinusHeader
+		prevWasMinusHeader = isMinusHeader
+		switch {
+		// A "+++ " line is only the file header when it immediately follows a "--- " header;
+		// otherwise it's an added content line that happens to start with "++" (e.g. the line's
+		// own text begins with "+ "), which --unified=0 renders identically.
+		case wasMinusHeader && strings.HasPrefix(line, "+++ "):
+			path := strings.TrimPrefix(strings.TrimPrefix(line, "+++ "), "b/")
+			if path == "/dev/null" {
+				currentFile = ""
+				continue
+			}
+			currentFile = path
+
+		case strings.HasPrefix(line, "@@ "):
+			if currentFile == "" {
+				continue
+			}
+			m := hunkHeader.FindStringSubmatch(line)
+			if m == nil {
+				continue
+			}
+			start, err := strconv.Atoi(m[1])
+			if err != nil {
+				return nil, fmt.Errorf("malformed hunk header %q, %v", line, err)
+			}
+			count := 1
+			if m[2] != "" {
+				if count, err = strconv.Atoi(m[2]); err != nil {
+					return nil, fmt.Errorf("malformed hunk header %q, %v", line, err)
+				}
+			}
+			if count == 0 {
+				// A pure deletion adds no new lines to check coverage for.
+				continue
+			}
+			changed[currentFile] = append(changed[currentFile], lineRange{start: start, end: start + count - 1})
+		}
+	}
+	return changed, scanner.Err()
+}
+
+// lineStatus records whether a source line falls inside an executable coverage block, and
+// whether that block was hit.
+type lineStatus struct {
+	executable, covered bool
+}
+
+// codeLines reads name's source and reports, per line number, whether the line holds anything
+// other than whitespace or a line comment. A coverage block's StartLine..EndLine span routinely
+// includes blank lines and stray comments that sit between the statements the block actually
+// covers (e.g. a comment between two arms of a switch), and counting those as executable inflates
+// both the denominator and the uncovered-line list. Returns nil if the source can't be read, in
+// which case the caller falls back to trusting the whole block span.
+func codeLines(name string) map[int]bool {
+	path, err := resolveSourceFile(name)
+	if err != nil {
+		glog.Warningf("cannot resolve source for %s, treating every block line as executable: %v", name, err)
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		glog.Warningf("cannot read source %s, treating every block line as executable: %v", path, err)
+		return nil
+	}
+	lines := make(map[int]bool)
+	for i, text := range strings.Split(string(data), "\n") {
+		trimmed := strings.TrimSpace(text)
+		if trimmed != "" && !strings.HasPrefix(trimmed, "//") {
+			lines[i+1] = true
+		}
+	}
+	return lines
+}
+
+func fileLineStatus(profile *cover.Profile) map[int]lineStatus {
+	code := codeLines(profile.FileName)
+	status := make(map[int]lineStatus)
+	for _, b := range profile.Blocks {
+		for line := b.StartLine; line <= b.EndLine; line++ {
+			if code != nil && !code[line] {
+				continue
+			}
+			st := status[line]
+			st.executable = true
+			if b.Count > 0 {
+				st.covered = true
+			}
+			status[line] = st
+		}
+	}
+	return status
+}
+
+// matchChangedFile finds the changed-file entry whose git-relative path is a suffix of a
+// coverprofile's import-path-qualified file name (e.g. "pilot/foo.go" for
+// "istio.io/istio/pilot/foo.go").
+func matchChangedFile(profileFile string, changed map[string][]lineRange) (string, []lineRange, bool) {
+	for gitFile, ranges := range changed {
+		if profileFile == gitFile || strings.HasSuffix(profileFile, "/"+gitFile) {
+			return gitFile, ranges, true
+		}
+	}
+	return "", nil, false
+}
+
+// diffCoverage intersects a go coverprofile with the changed line ranges, returning how many of
+// the changed executable lines are covered and the file:line locations of the ones that are not.
+func diffCoverage(profileFile string, changed map[string][]lineRange) (covered, total int, uncovered []string, err error) {
+	profiles, err := cover.ParseProfiles(profileFile)
+	if err != nil {
+		return 0, 0, nil, fmt.Errorf("failed to parse coverage profile %s, %v", profileFile, err)
+	}
+
+	for _, profile := range profiles {
+		gitFile, ranges, ok := matchChangedFile(profile.FileName, changed)
+		if !ok {
+			continue
+		}
+		status := fileLineStatus(profile)
+		for _, r := range ranges {
+			for line := r.start; line <= r.end; line++ {
+				st, ok := status[line]
+				if !ok || !st.executable {
+					continue
+				}
+				total++
+				if st.covered {
+					covered++
+				} else {
+					uncovered = append(uncovered, fmt.Sprintf("%s:%d", gitFile, line))
+				}
+			}
+		}
+	}
+	sort.Strings(uncovered)
+	return covered, total, uncovered, nil
+}
+
+// checkDiffCoverage computes coverage over only the lines changed between diffBase and diffHead
+// and fails if that percentage falls below diffThreshold.
+func checkDiffCoverage(reportFile, diffBase, diffHead string, diffThreshold float64) error {
+	changed, err := gitDiffLines(diffBase, diffHead)
+	if err != nil {
+		return fmt.Errorf("failed to compute changed lines between %s and %s: %v", diffBase, diffHead, err)
+	}
+
+	covered, total, uncovered, err := diffCoverage(reportFile, changed)
+	if err != nil {
+		return fmt.Errorf("failed to compute diff coverage from %s: %v", reportFile, err)
+	}
+	if total == 0 {
+		glog.Infof("Diff coverage: no changed executable lines between %s and %s", diffBase, diffHead)
+		return nil
+	}
+
+	pct := float64(covered) / float64(total) * 100
+	glog.Infof("Diff coverage: %d/%d changed lines covered (%.2f%%)", covered, total, pct)
+	for _, loc := range uncovered {
+		glog.Errorf("Uncovered changed line: %s", loc)
+	}
+
+	if pct < diffThreshold {
+		return fmt.Errorf("diff coverage %.2f%% is below the required %.2f%%", pct, diffThreshold)
+	}
+	return nil
+}
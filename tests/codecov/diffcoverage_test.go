@@ -0,0 +1,120 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseUnifiedDiff(t *testing.T) {
+	cases := []struct {
+		name    string
+		diff    string
+		want    map[string][]lineRange
+		wantErr bool
+	}{
+		{
+			name: "single hunk, added lines",
+			diff: "diff --git a/foo.go b/foo.go\n" +
+				"--- a/foo.go\n" +
+				"+++ b/foo.go\n" +
+				"@@ -10,0 +11,3 @@ func foo() {\n" +
+				"+line one\n" +
+				"+line two\n" +
+				"+line three\n",
+			want: map[string][]lineRange{
+				"foo.go": {{start: 11, end: 13}},
+			},
+		},
+		{
+			name: "single line hunk has no explicit count",
+			diff: "--- a/foo.go\n" +
+				"+++ b/foo.go\n" +
+				"@@ -5 +5 @@\n" +
+				"-old\n" +
+				"+new\n",
+			want: map[string][]lineRange{
+				"foo.go": {{start: 5, end: 5}},
+			},
+		},
+		{
+			name: "pure deletion adds no changed lines",
+			diff: "--- a/foo.go\n" +
+				"+++ b/foo.go\n" +
+				"@@ -10,3 +10,0 @@\n" +
+				"-line one\n" +
+				"-line two\n" +
+				"-line three\n",
+			want: map[string][]lineRange{},
+		},
+		{
+			name: "deleted file is ignored",
+			diff: "--- a/foo.go\n" +
+				"+++ /dev/null\n" +
+				"@@ -1,3 +0,0 @@\n" +
+				"-line one\n",
+			want: map[string][]lineRange{},
+		},
+		{
+			name: "added content line starting with ++ is not mistaken for a file header",
+			diff: "--- a/foo.go\n" +
+				"+++ b/foo.go\n" +
+				"@@ -10,0 +11,2 @@\n" +
+				"+++ compile-time tag\n" +
+				"+normal line\n",
+			want: map[string][]lineRange{
+				"foo.go": {{start: 11, end: 12}},
+			},
+		},
+		{
+			name: "multiple files each get their own ranges",
+			diff: "--- a/foo.go\n" +
+				"+++ b/foo.go\n" +
+				"@@ -1,0 +2,1 @@\n" +
+				"+foo change\n" +
+				"--- a/bar.go\n" +
+				"+++ b/bar.go\n" +
+				"@@ -9,0 +10,2 @@\n" +
+				"+bar change one\n" +
+				"+bar change two\n",
+			want: map[string][]lineRange{
+				"foo.go": {{start: 2, end: 2}},
+				"bar.go": {{start: 10, end: 11}},
+			},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got, err := parseUnifiedDiff([]byte(c.diff))
+			if c.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(got) == 0 {
+				got = map[string][]lineRange{}
+			}
+			if !reflect.DeepEqual(got, c.want) {
+				t.Fatalf("parseUnifiedDiff() = %+v, want %+v", got, c.want)
+			}
+		})
+	}
+}
@@ -19,20 +19,39 @@ import (
 	"errors"
 	"flag"
 	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
 	"os"
+	"os/exec"
+	stdpath "path"
+	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
 
 	"github.com/golang/glog"
+	"golang.org/x/tools/cover"
 )
 
 var (
-	reportFile    = flag.String("report_file", "", "Code coverage report file")
-	baselineFile  = flag.String("baseline_file", "", "Code coverage baseline file")
+	reportFile    = flag.String("report_file", "", "Code coverage report file (codecov HTML report or go coverprofile)")
+	baselineFile  = flag.String("baseline_file", "", "Code coverage baseline file (codecov HTML report or go coverprofile)")
 	thresholdFile = flag.String("threshold_file", "", "File containing package to threshold mappings, as overrides")
+
+	junitOut     = flag.String("junit_out", "", "If set, write a JUnit XML report of the per-package coverage check to this path")
+	coberturaOut = flag.String("cobertura_out", "", "If set, write a Cobertura XML coverage report to this path")
+	markdownOut  = flag.String("markdown_out", "", "If set, write a markdown summary table of packages whose coverage moved to this path")
+
+	diffBase      = flag.String("diff_base", "", "If set, also check coverage of lines changed between this git ref and -diff_head, using -report_file as a go coverprofile. Diffed via git's three-dot (merge-base) syntax, so this should name an ancestor of -diff_head, e.g. the PR's target branch")
+	diffHead      = flag.String("diff_head", "HEAD", "The git ref at the head of the diff coverage range")
+	diffThreshold = flag.Float64("diff_threshold", 80, "Minimum required coverage percentage of changed lines, in diff coverage mode")
 )
 
+// coverProfileLine matches a go coverprofile record, e.g.
+// istio.io/istio/galley/cmd/shared/shared.go:10.2,14.3 2 1
+var coverProfileLine = regexp.MustCompile(`^(.+):(\d+)\.(\d+),(\d+)\.(\d+) (\d+) (\d+)$`)
+
 func parseReportLine(line string) (string, float64, error) {
 	// <option value="file0">istio.io/istio/galley/cmd/shared/shared.go (0.0%)</option>
 	reg := regexp.MustCompile(` *<option value=\"(.*)\">(.*) \((.*)%\)</option>`)
@@ -46,12 +65,13 @@ func parseReportLine(line string) (string, float64, error) {
 	return "", 0, fmt.Errorf("no coverage in %s", line)
 }
 
+// parseReport reads a coverage report and returns per-file coverage percentages. The file can
+// either be a codecov HTML dump or a standard go coverprofile (as produced by
+// `go test -coverprofile`); the format is auto-detected from the first line.
 func parseReport(filename string) (map[string]float64, error) {
-	coverage := make(map[string]float64)
-
 	f, err := os.Open(filename)
 	if err != nil {
-		return coverage, fmt.Errorf("failed to open file %s, %v", filename, err)
+		return nil, fmt.Errorf("failed to open file %s, %v", filename, err)
 	}
 	defer func() {
 		if err = f.Close(); err != nil {
@@ -60,6 +80,18 @@ func parseReport(filename string) (map[string]float64, error) {
 	}()
 
 	scanner := bufio.NewScanner(f)
+	if !scanner.Scan() {
+		return make(map[string]float64), scanner.Err()
+	}
+	firstLine := scanner.Text()
+	if strings.HasPrefix(firstLine, "mode: ") {
+		return parseCoverProfile(scanner)
+	}
+
+	coverage := make(map[string]float64)
+	if pkg, cov, err := parseReportLine(firstLine); err == nil {
+		coverage[pkg] = cov
+	}
 	for scanner.Scan() {
 		if pkg, cov, err := parseReportLine(scanner.Text()); err == nil {
 			coverage[pkg] = cov
@@ -68,39 +100,269 @@ func parseReport(filename string) (map[string]float64, error) {
 	return coverage, scanner.Err()
 }
 
-func parseThreshold(thresholdFile string) (map[string]float64, error) {
-	f, err := os.Open(thresholdFile)
+// parseCoverProfile aggregates a go coverprofile (everything after the "mode:" header) into
+// per-file coverage percentages, computed as covered statements / total statements * 100.
+func parseCoverProfile(scanner *bufio.Scanner) (map[string]float64, error) {
+	type stmtCount struct {
+		total, covered int
+	}
+	stats := make(map[string]*stmtCount)
+
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			continue
+		}
+		m := coverProfileLine.FindStringSubmatch(line)
+		if m == nil {
+			return nil, fmt.Errorf("malformed coverage profile line: %s", line)
+		}
+		numStmt, err := strconv.Atoi(m[6])
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse statement count in %s, %v", line, err)
+		}
+		count, err := strconv.Atoi(m[7])
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse hit count in %s, %v", line, err)
+		}
+
+		file := m[1]
+		s, ok := stats[file]
+		if !ok {
+			s = &stmtCount{}
+			stats[file] = s
+		}
+		s.total += numStmt
+		if count > 0 {
+			s.covered += numStmt
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	coverage := make(map[string]float64, len(stats))
+	for file, s := range stats {
+		if s.total == 0 {
+			coverage[file] = 0
+			continue
+		}
+		coverage[file] = float64(s.covered) / float64(s.total) * 100
+	}
+	return coverage, nil
+}
+
+// fileStatementWeights returns each file's total statement count from a go coverprofile, for
+// weighting aggregate coverage by package size (see writeCoberturaReport). It returns a nil map,
+// without error, for codecov HTML reports, which carry no statement counts.
+func fileStatementWeights(filename string) (map[string]int, error) {
+	isProfile, err := isCoverProfileFile(filename)
 	if err != nil {
-		return nil, fmt.Errorf("failed to open threshold file, %s, %v", thresholdFile, err)
+		return nil, fmt.Errorf("failed to inspect file %s, %v", filename, err)
+	}
+	if !isProfile {
+		return nil, nil
+	}
+
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file %s, %v", filename, err)
 	}
 	defer func() {
 		if err = f.Close(); err != nil {
-			glog.Errorf("failed to close file %s, %v", thresholdFile, err)
+			glog.Warningf("failed to close file %s, %v", filename, err)
 		}
 	}()
 
 	scanner := bufio.NewScanner(f)
-	reg := regexp.MustCompile(`(.*)=(.*)`)
-
-	thresholds := make(map[string]float64)
+	if !scanner.Scan() {
+		return nil, scanner.Err()
+	}
 
+	weights := make(map[string]int)
 	for scanner.Scan() {
-		line := strings.TrimSpace(scanner.Text())
-		if strings.HasPrefix(line, "#") {
-			// Skip comments
+		line := scanner.Text()
+		if line == "" {
 			continue
 		}
-		m := reg.FindStringSubmatch(line)
-		if len(m) == 3 {
-			threshold, err := strconv.ParseFloat(strings.TrimSpace(m[2]), 64)
-			if err != nil {
-				return nil, fmt.Errorf("failed to parse threshold to float64 for package %s: %s, %v",
-					m[1], m[2], err)
+		m := coverProfileLine.FindStringSubmatch(line)
+		if m == nil {
+			return nil, fmt.Errorf("malformed coverage profile line: %s", line)
+		}
+		numStmt, err := strconv.Atoi(m[6])
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse statement count in %s, %v", line, err)
+		}
+		weights[m[1]] += numStmt
+	}
+	return weights, scanner.Err()
+}
+
+// FuncKey identifies a single function for per-function coverage tracking.
+type FuncKey struct {
+	File string
+	Func string
+}
+
+func (k FuncKey) String() string {
+	return fmt.Sprintf("%s.%s", k.File, k.Func)
+}
+
+// funcExtent is the line/column range of a single top-level function or method declaration.
+type funcExtent struct {
+	name                string
+	startLine, startCol int
+	endLine, endCol     int
+}
+
+// coverage returns the covered and total statement counts for the blocks of profile that fall
+// within the function's extent.
+func (f *funcExtent) coverage(profile *cover.Profile) (covered, total int) {
+	for _, b := range profile.Blocks {
+		if b.StartLine > f.endLine || (b.StartLine == f.endLine && b.StartCol >= f.endCol) {
+			continue
+		}
+		if b.EndLine < f.startLine || (b.EndLine == f.startLine && b.EndCol <= f.startCol) {
+			continue
+		}
+		total += b.NumStmt
+		if b.Count > 0 {
+			covered += b.NumStmt
+		}
+	}
+	return covered, total
+}
+
+// findFuncs parses a Go source file and returns the extent of every function and method
+// declared in it.
+func findFuncs(name string) ([]*funcExtent, error) {
+	fset := token.NewFileSet()
+	parsedFile, err := parser.ParseFile(fset, name, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	var funcs []*funcExtent
+	ast.Inspect(parsedFile, func(n ast.Node) bool {
+		decl, ok := n.(*ast.FuncDecl)
+		if !ok || decl.Body == nil {
+			return true
+		}
+		name := decl.Name.Name
+		if decl.Recv != nil && len(decl.Recv.List) > 0 {
+			name = recvTypeName(decl.Recv.List[0].Type) + "." + name
+		}
+		start := fset.Position(decl.Pos())
+		end := fset.Position(decl.End())
+		funcs = append(funcs, &funcExtent{
+			name:      name,
+			startLine: start.Line,
+			startCol:  start.Column,
+			endLine:   end.Line,
+			endCol:    end.Column,
+		})
+		return true
+	})
+	return funcs, nil
+}
+
+func recvTypeName(expr ast.Expr) string {
+	switch t := expr.(type) {
+	case *ast.StarExpr:
+		return recvTypeName(t.X)
+	case *ast.Ident:
+		return t.Name
+	default:
+		return ""
+	}
+}
+
+// resolveSourceFile locates the on-disk source for a coverprofile entry, which is recorded as an
+// import path (e.g. istio.io/istio/pilot/pkg/config/foo.go) rather than a filesystem path. It
+// shells out to `go list`, which resolves the package directory whether the caller's working
+// directory is inside a GOPATH workspace or a module (unlike go/build's GOPATH-only Import).
+func resolveSourceFile(name string) (string, error) {
+	if _, err := os.Stat(name); err == nil {
+		return name, nil
+	}
+	out, err := exec.Command("go", "list", "-f", "{{.Dir}}", stdpath.Dir(name)).Output()
+	if err != nil {
+		return "", fmt.Errorf("cannot find source for %s, %v", name, err)
+	}
+	dir := strings.TrimSpace(string(out))
+	if dir == "" {
+		return "", fmt.Errorf("cannot find source for %s: go list returned no directory", name)
+	}
+	return filepath.Join(dir, stdpath.Base(name)), nil
+}
+
+// isCoverProfileFile reports whether filename is a go coverprofile, as opposed to a codecov HTML
+// report, by checking for the "mode: " header on its first line.
+func isCoverProfileFile(filename string) (bool, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return false, fmt.Errorf("failed to open file %s, %v", filename, err)
+	}
+	defer func() {
+		if err = f.Close(); err != nil {
+			glog.Warningf("failed to close file %s, %v", filename, err)
+		}
+	}()
+
+	scanner := bufio.NewScanner(f)
+	if !scanner.Scan() {
+		return false, scanner.Err()
+	}
+	return strings.HasPrefix(scanner.Text(), "mode: "), nil
+}
+
+// parseFuncReport computes per-function coverage percentages from a go coverprofile. It returns
+// a nil map, without error, for codecov HTML reports, since those carry no function-level data.
+func parseFuncReport(filename string) (map[FuncKey]float64, error) {
+	isProfile, err := isCoverProfileFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to inspect file %s, %v", filename, err)
+	}
+	if !isProfile {
+		return nil, nil
+	}
+
+	profiles, err := cover.ParseProfiles(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse coverage profile %s, %v", filename, err)
+	}
+
+	coverage := make(map[FuncKey]float64)
+	skipped := 0
+	for _, profile := range profiles {
+		srcFile, err := resolveSourceFile(profile.FileName)
+		if err != nil {
+			glog.Warningf("skipping function coverage for %s, %v", profile.FileName, err)
+			skipped++
+			continue
+		}
+		funcs, err := findFuncs(srcFile)
+		if err != nil {
+			glog.Warningf("skipping function coverage for %s, %v", profile.FileName, err)
+			skipped++
+			continue
+		}
+		for _, fn := range funcs {
+			covered, total := fn.coverage(profile)
+			if total == 0 {
+				continue
 			}
-			thresholds[strings.TrimSpace(m[1])] = threshold
+			coverage[FuncKey{File: profile.FileName, Func: fn.name}] = float64(covered) / float64(total) * 100
 		}
 	}
-	return thresholds, scanner.Err()
+	if skipped == len(profiles) && skipped > 0 {
+		glog.Errorf("function coverage: could not resolve source for any of the %d profiled files; "+
+			"per-function coverage gating is not being enforced for %s", skipped, filename)
+	} else if skipped > 0 {
+		glog.Warningf("function coverage: skipped %d/%d files whose source could not be resolved; "+
+			"per-function rules for those files are not enforced", skipped, len(profiles))
+	}
+	return coverage, nil
 }
 
 func findDelta(report, baseline map[string]float64) map[string]float64 {
@@ -118,7 +380,7 @@ func findDelta(report, baseline map[string]float64) map[string]float64 {
 	return deltas
 }
 
-func checkDelta(deltas, report, baseline, thresholds map[string]float64) bool {
+func checkDelta(deltas, report, baseline map[string]float64, rules []thresholdRule) bool {
 	result := true
 	// First print all coverage change.
 	for pkg, delta := range deltas {
@@ -127,28 +389,86 @@ func checkDelta(deltas, report, baseline, thresholds map[string]float64) bool {
 
 	// Then generate errors for reduced coverage.
 	for pkg, delta := range deltas {
-		if delta+getThreshold(thresholds, pkg) < 0 {
-			glog.Errorf("Coverage dropped: %s:%f%% (%f%% to %f%%)", pkg, delta, baseline[pkg], report[pkg])
+		rule := resolveRule(rules, pkg)
+		if !passesRule(rule, delta, report[pkg]) {
+			glog.Errorf("Coverage dropped: %s:%f%% (%f%% to %f%%) [rule: %s]",
+				pkg, delta, baseline[pkg], report[pkg], describeRule(rule))
 			result = false
 		}
 	}
 	return result
 }
 
-func getThreshold(thresholds map[string]float64, path string) float64 {
-	matchedThreshold := 0.0
-	matchedPackageLebgth := 0
-	for pkg, threshold := range thresholds {
-		// Find the threshold that matches the longest package prefix.
-		if strings.HasPrefix(path, pkg) && len(pkg) > matchedPackageLebgth {
-			matchedPackageLebgth = len(pkg)
-			matchedThreshold = threshold
+// findFuncDelta compares functions present in both report and baseline. A function that
+// disappeared from report is most often renamed or moved rather than untested code that
+// regressed, so (unlike findDelta at the package level) it is not treated as a drop to zero.
+func findFuncDelta(report, baseline map[FuncKey]float64) map[FuncKey]float64 {
+	deltas := make(map[FuncKey]float64)
+
+	for fn, cov := range report {
+		if base, exist := baseline[fn]; exist {
+			deltas[fn] = cov - base
 		}
 	}
-	return matchedThreshold
+	return deltas
 }
 
-func checkCoverage(reportFile, baselineFile, thresholdFile string) error {
+// checkFuncDelta only gates functions whose "pkgpath.Func" key a threshold rule matches (see
+// resolveFuncRule); bare package/file rules and the zero-tolerance default apply at the package
+// level via checkDelta, not to every individual function. It walks report rather than deltas so that an
+// absolute-floor rule still fires for a new or renamed function that has no baseline entry (and
+// therefore no delta); only delta-tolerance rules, which are meaningless without a baseline to
+// compare against, are restricted to functions present in both report and baseline.
+func checkFuncDelta(deltas, report, baseline map[FuncKey]float64, rules []thresholdRule) bool {
+	result := true
+	// First print all coverage change.
+	for fn, delta := range deltas {
+		glog.Infof("Function coverage change: %s:%f%% (%f%% to %f%%)", fn, delta, baseline[fn], report[fn])
+	}
+
+	// Then generate errors, but only where a rule explicitly targets fn.
+	for fn, cov := range report {
+		rule := resolveFuncRule(rules, fn)
+		if rule == nil {
+			continue
+		}
+		if rule.kind == absoluteFloor {
+			if !passesRule(rule, 0, cov) {
+				glog.Errorf("Function coverage below floor: %s:%f%% [rule: %s]", fn, cov, describeRule(rule))
+				result = false
+			}
+			continue
+		}
+		delta, exist := deltas[fn]
+		if !exist {
+			// No baseline to measure a drop from (new or renamed function); nothing for a
+			// delta-tolerance rule to gate.
+			continue
+		}
+		if !passesRule(rule, delta, cov) {
+			glog.Errorf("Function coverage dropped: %s:%f%% (%f%% to %f%%) [rule: %s]",
+				fn, delta, baseline[fn], cov, describeRule(rule))
+			result = false
+		}
+	}
+	return result
+}
+
+// resolveFuncRule looks up a per-function override (package_path.FuncName={=,>=}value). It never
+// falls back to a plain package/file rule: those already apply at the package level via
+// checkDelta, and falling back here would gate every function at the package's tolerance by
+// default. Glob and `re:` patterns are matched against the whole "package_path.FuncName" key, so
+// one that matches such keys (e.g. `istio.io/istio/pilot/**`) gates functions as well as files.
+//
+// Use `>=` to require a function stay above a minimum coverage percentage (e.g.
+// `istio.io/istio/pilot/pkg/config.Foo >= 90`); a bare `=` rule is a delta tolerance, not a floor, and is only
+// evaluated relative to the same function's own baseline coverage.
+func resolveFuncRule(rules []thresholdRule, fn FuncKey) *thresholdRule {
+	key := stdpath.Dir(fn.File) + "." + fn.Func
+	return resolveExactRule(rules, key)
+}
+
+func checkCoverage(reportFile, baselineFile, thresholdFile, junitOut, coberturaOut, markdownOut string) error {
 	report, err := parseReport(reportFile)
 	if err != nil {
 		return fmt.Errorf("cannot open or parse report file: %s, %v", reportFile, err)
@@ -162,8 +482,45 @@ func checkCoverage(reportFile, baselineFile, thresholdFile string) error {
 		return fmt.Errorf("cannot open or parse threshold file: %s, %v", thresholdFile, err)
 	}
 	deltas := findDelta(report, baseline)
+	ok := checkDelta(deltas, report, baseline, thresholds)
+
+	funcReport, err := parseFuncReport(reportFile)
+	if err != nil {
+		return fmt.Errorf("cannot compute per-function coverage for report file: %s, %v", reportFile, err)
+	}
+	funcBaseline, err := parseFuncReport(baselineFile)
+	if err != nil {
+		return fmt.Errorf("cannot compute per-function coverage for baseline file: %s, %v", baselineFile, err)
+	}
+	if funcReport != nil && funcBaseline != nil {
+		funcDeltas := findFuncDelta(funcReport, funcBaseline)
+		if !checkFuncDelta(funcDeltas, funcReport, funcBaseline, thresholds) {
+			ok = false
+		}
+	}
+
+	weights, err := fileStatementWeights(reportFile)
+	if err != nil {
+		return fmt.Errorf("cannot compute statement weights for report file: %s, %v", reportFile, err)
+	}
+	results := buildPackageResults(deltas, report, baseline, thresholds, weights)
+	if junitOut != "" {
+		if err := writeJUnitReport(junitOut, results); err != nil {
+			glog.Errorf("failed to write JUnit report %s, %v", junitOut, err)
+		}
+	}
+	if coberturaOut != "" {
+		if err := writeCoberturaReport(coberturaOut, results); err != nil {
+			glog.Errorf("failed to write Cobertura report %s, %v", coberturaOut, err)
+		}
+	}
+	if markdownOut != "" {
+		if err := writeMarkdownReport(markdownOut, results); err != nil {
+			glog.Errorf("failed to write markdown report %s, %v", markdownOut, err)
+		}
+	}
 
-	if !checkDelta(deltas, report, baseline, thresholds) {
+	if !ok {
 		return errors.New("some test coverage has dropped more than the allowed threshold")
 	}
 	return nil
@@ -173,9 +530,21 @@ func checkCoverage(reportFile, baselineFile, thresholdFile string) error {
 // code coverage has dropped above the given threshold.
 func main() {
 	flag.Parse()
-	err := checkCoverage(*reportFile, *baselineFile, *thresholdFile)
-	if err != nil {
+	failed := false
+
+	if err := checkCoverage(*reportFile, *baselineFile, *thresholdFile, *junitOut, *coberturaOut, *markdownOut); err != nil {
 		glog.Error(err)
+		failed = true
+	}
+
+	if *diffBase != "" {
+		if err := checkDiffCoverage(*reportFile, *diffBase, *diffHead, *diffThreshold); err != nil {
+			glog.Error(err)
+			failed = true
+		}
+	}
+
+	if failed {
 		os.Exit(1)
 	}
 	os.Exit(0)
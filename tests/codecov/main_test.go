@@ -0,0 +1,108 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"strings"
+	"testing"
+)
+
+func TestCheckFuncDeltaFloorGatesNewFunction(t *testing.T) {
+	rule := mustRule(t, "pilot/pkg/security.NewHandler", absoluteFloor, 85, false)
+	report := map[FuncKey]float64{{File: "pilot/pkg/security/handler.go", Func: "NewHandler"}: 0}
+	baseline := map[FuncKey]float64{}
+	deltas := findFuncDelta(report, baseline)
+
+	if checkFuncDelta(deltas, report, baseline, []thresholdRule{rule}) {
+		t.Fatalf("expected a brand-new function below its floor to fail the check")
+	}
+}
+
+func TestCheckFuncDeltaToleranceSkipsFunctionsWithoutBaseline(t *testing.T) {
+	rule := mustRule(t, "pilot/pkg/security.NewHandler", deltaTolerance, 0, false)
+	report := map[FuncKey]float64{{File: "pilot/pkg/security/handler.go", Func: "NewHandler"}: 0}
+	baseline := map[FuncKey]float64{}
+	deltas := findFuncDelta(report, baseline)
+
+	if !checkFuncDelta(deltas, report, baseline, []thresholdRule{rule}) {
+		t.Fatalf("a delta-tolerance rule has nothing to measure a drop from for a new function; it should not fail the check")
+	}
+}
+
+func TestParseCoverProfile(t *testing.T) {
+	cases := []struct {
+		name     string
+		profile  string
+		wantErr  bool
+		expected map[string]float64
+	}{
+		{
+			name: "single file, fully covered",
+			profile: "foo.go:1.1,3.2 2 1\n" +
+				"foo.go:4.1,5.2 1 1\n",
+			expected: map[string]float64{"foo.go": 100},
+		},
+		{
+			name: "single file, partially covered",
+			profile: "foo.go:1.1,3.2 2 1\n" +
+				"foo.go:4.1,5.2 2 0\n",
+			expected: map[string]float64{"foo.go": 50},
+		},
+		{
+			name:     "uncovered file reports zero, not NaN",
+			profile:  "foo.go:1.1,3.2 2 0\n",
+			expected: map[string]float64{"foo.go": 0},
+		},
+		{
+			name:     "multiple files aggregated independently",
+			profile:  "foo.go:1.1,3.2 2 1\nbar.go:1.1,2.2 4 0\n",
+			expected: map[string]float64{"foo.go": 100, "bar.go": 0},
+		},
+		{
+			name:    "malformed line",
+			profile: "not a coverage line\n",
+			wantErr: true,
+		},
+		{
+			name:     "blank lines are skipped",
+			profile:  "foo.go:1.1,3.2 2 1\n\nfoo.go:4.1,5.2 2 1\n",
+			expected: map[string]float64{"foo.go": 100},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got, err := parseCoverProfile(bufio.NewScanner(strings.NewReader(c.profile)))
+			if c.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(got) != len(c.expected) {
+				t.Fatalf("got %v, want %v", got, c.expected)
+			}
+			for file, want := range c.expected {
+				if got[file] != want {
+					t.Errorf("coverage[%s] = %f, want %f", file, got[file], want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,217 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// packageResult is the outcome of the coverage check for a single package, shared by all of the
+// CI report writers below.
+type packageResult struct {
+	Package   string
+	Baseline  float64
+	Report    float64
+	Delta     float64
+	Threshold float64
+	// Kind is the rule kind Threshold was read from (deltaTolerance if no rule matched), so
+	// writers can phrase a failure in terms of the rule that actually produced it.
+	Kind   ruleKind
+	Passed bool
+	// Weight is the package's total statement count, used to weight the project-level
+	// aggregate in writeCoberturaReport. It is 0 when statement counts aren't available (e.g.
+	// the report is a codecov HTML dump rather than a coverprofile).
+	Weight int
+}
+
+// buildPackageResults turns the raw coverage maps into a deterministically ordered list of
+// per-package results, ready to feed to the JUnit, Cobertura and markdown writers. weights may be
+// nil, in which case every package reports a zero Weight.
+func buildPackageResults(deltas, report, baseline map[string]float64, rules []thresholdRule, weights map[string]int) []packageResult {
+	pkgs := make([]string, 0, len(deltas))
+	for pkg := range deltas {
+		pkgs = append(pkgs, pkg)
+	}
+	sort.Strings(pkgs)
+
+	results := make([]packageResult, 0, len(pkgs))
+	for _, pkg := range pkgs {
+		delta := deltas[pkg]
+		rule := resolveRule(rules, pkg)
+		threshold := 0.0
+		kind := deltaTolerance
+		if rule != nil {
+			threshold = rule.value
+			kind = rule.kind
+		}
+		results = append(results, packageResult{
+			Package:   pkg,
+			Baseline:  baseline[pkg],
+			Report:    report[pkg],
+			Delta:     delta,
+			Threshold: threshold,
+			Kind:      kind,
+			Passed:    passesRule(rule, delta, report[pkg]),
+			Weight:    weights[pkg],
+		})
+	}
+	return results
+}
+
+// JUnit XML schema, as consumed by most CI dashboards (Jenkins, Azure Pipelines, GitHub Actions).
+type junitTestsuite struct {
+	XMLName   xml.Name        `xml:"testsuite"`
+	Name      string          `xml:"name,attr"`
+	Tests     int             `xml:"tests,attr"`
+	Failures  int             `xml:"failures,attr"`
+	Testcases []junitTestcase `xml:"testcase"`
+}
+
+type junitTestcase struct {
+	Name      string        `xml:"name,attr"`
+	Classname string        `xml:"classname,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Text    string `xml:",chardata"`
+}
+
+// writeJUnitReport writes one <testcase> per package, with a <failure> for every package whose
+// coverage dropped past its delta tolerance or fell below its absolute floor.
+func writeJUnitReport(filename string, results []packageResult) error {
+	suite := junitTestsuite{
+		Name:  "coverage",
+		Tests: len(results),
+	}
+	for _, r := range results {
+		tc := junitTestcase{
+			Name:      r.Package,
+			Classname: "coverage",
+		}
+		if !r.Passed {
+			suite.Failures++
+			message := fmt.Sprintf("coverage dropped %.2f%% past the %.2f%% threshold", -r.Delta, r.Threshold)
+			if r.Kind == absoluteFloor {
+				// Delta is meaningless here: this package can fail a floor even with rising
+				// coverage, so "dropped" (and a possibly-negative figure) would be nonsensical.
+				message = fmt.Sprintf("coverage %.2f%% is below the required %.2f%% floor", r.Report, r.Threshold)
+			}
+			tc.Failure = &junitFailure{
+				Message: message,
+				Text: fmt.Sprintf("%s: %.2f%% -> %.2f%% (delta %.2f%%, threshold %.2f%%)",
+					r.Package, r.Baseline, r.Report, r.Delta, r.Threshold),
+			}
+		}
+		suite.Testcases = append(suite.Testcases, tc)
+	}
+	return writeXML(filename, suite)
+}
+
+// Cobertura XML schema, as expected by the Jenkins/Azure Pipelines Cobertura publishers.
+type coberturaCoverage struct {
+	XMLName    xml.Name          `xml:"coverage"`
+	LineRate   string            `xml:"line-rate,attr"`
+	BranchRate string            `xml:"branch-rate,attr"`
+	Version    string            `xml:"version,attr"`
+	Packages   coberturaPackages `xml:"packages"`
+}
+
+type coberturaPackages struct {
+	Package []coberturaPackage `xml:"package"`
+}
+
+type coberturaPackage struct {
+	Name       string `xml:"name,attr"`
+	LineRate   string `xml:"line-rate,attr"`
+	BranchRate string `xml:"branch-rate,attr"`
+}
+
+// writeCoberturaReport writes a project-level line-rate/branch-rate plus one package entry per
+// package, in the 0-1 rate scale Cobertura expects rather than our usual 0-100 percentage.
+//
+// The project line-rate is weighted by each package's statement count (via packageResult.Weight)
+// rather than averaged across packages, so a handful of tiny packages can't dominate the
+// project-level number the way a plain mean of percentages would. A package without a statement
+// count (Weight 0) counts with weight 1, so for codecov HTML reports, which carry no statement
+// counts, the project line-rate is the plain mean of the package rates. Go's coverage instrumentation
+// is statement-based with no distinct branch data, so branch-rate mirrors line-rate everywhere,
+// the same approximation other go-to-Cobertura converters (e.g. gocov-xml) make.
+func writeCoberturaReport(filename string, results []packageResult) error {
+	pkgs := make([]coberturaPackage, 0, len(results))
+	var weightedCovered, totalWeight float64
+	for _, r := range results {
+		rate := fmt.Sprintf("%.4f", r.Report/100)
+		pkgs = append(pkgs, coberturaPackage{
+			Name:       r.Package,
+			LineRate:   rate,
+			BranchRate: rate,
+		})
+
+		weight := float64(r.Weight)
+		if weight <= 0 {
+			weight = 1
+		}
+		weightedCovered += weight * r.Report / 100
+		totalWeight += weight
+	}
+
+	projectRate := 0.0
+	if totalWeight > 0 {
+		projectRate = weightedCovered / totalWeight
+	}
+
+	cov := coberturaCoverage{
+		LineRate:   fmt.Sprintf("%.4f", projectRate),
+		BranchRate: fmt.Sprintf("%.4f", projectRate),
+		Version:    "1.9",
+		Packages:   coberturaPackages{Package: pkgs},
+	}
+	return writeXML(filename, cov)
+}
+
+func writeXML(filename string, v interface{}) error {
+	data, err := xml.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal %s, %v", filename, err)
+	}
+	if err := os.WriteFile(filename, append([]byte(xml.Header), data...), 0644); err != nil {
+		return fmt.Errorf("failed to write file %s, %v", filename, err)
+	}
+	return nil
+}
+
+// writeMarkdownReport writes a PR-comment friendly table of the packages whose coverage moved.
+func writeMarkdownReport(filename string, results []packageResult) error {
+	var b strings.Builder
+	b.WriteString("| Package | Baseline | Coverage | Delta | Status |\n")
+	b.WriteString("|---|---|---|---|---|\n")
+	for _, r := range results {
+		if r.Delta == 0 {
+			continue
+		}
+		status := "pass"
+		if !r.Passed {
+			status = "FAIL"
+		}
+		fmt.Fprintf(&b, "| %s | %.2f%% | %.2f%% | %+.2f%% | %s |\n", r.Package, r.Baseline, r.Report, r.Delta, status)
+	}
+	return os.WriteFile(filename, []byte(b.String()), 0644)
+}
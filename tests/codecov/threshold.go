@@ -0,0 +1,257 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/golang/glog"
+)
+
+type ruleKind int
+
+const (
+	deltaTolerance ruleKind = iota
+	absoluteFloor
+)
+
+// regexSpecialChars are the characters that can start a regex metacharacter sequence; used to
+// find the longest literal prefix of a `re:` pattern for "most specific wins" precedence.
+const regexSpecialChars = `.*+?()[]{}|^$\`
+
+// thresholdRule is a single line of the threshold file, compiled into a matcher.
+type thresholdRule struct {
+	pattern       string
+	kind          ruleKind
+	value         float64
+	authoritative bool
+	specificity   int
+	match         func(path string) bool
+	// plain is true for a bare pattern (no glob metachar, no `re:` prefix), whose match func
+	// does a prefix match. Callers that need an exact match against such a pattern (e.g.
+	// per-function keys, where "config.Foo" must not also match "config.FooBar") should compare
+	// against pattern directly instead of calling match.
+	plain bool
+}
+
+func literalPrefixLen(s string) int {
+	if idx := strings.IndexAny(s, regexSpecialChars); idx >= 0 {
+		return idx
+	}
+	return len(s)
+}
+
+// globToRegexp converts a pattern using `*` (any run of non-slash characters) and `**` (any run
+// of characters, including slashes) into an anchored regular expression.
+func globToRegexp(pattern string) string {
+	var b strings.Builder
+	b.WriteString("^")
+	for i := 0; i < len(pattern); {
+		switch {
+		case strings.HasPrefix(pattern[i:], "**"):
+			b.WriteString(".*")
+			i += 2
+		case pattern[i] == '*':
+			b.WriteString("[^/]*")
+			i++
+		default:
+			b.WriteString(regexp.QuoteMeta(string(pattern[i])))
+			i++
+		}
+	}
+	b.WriteString("$")
+	return b.String()
+}
+
+// compileRule turns a threshold pattern into a matcher and its specificity (the longest literal
+// prefix, used to break ties between overlapping rules). A bare pattern with no glob metachar and
+// no `re:` prefix keeps the original longest-prefix-match behavior.
+func compileRule(pattern string) (match func(string) bool, specificity int, plain bool, err error) {
+	switch {
+	case strings.HasPrefix(pattern, "re:"):
+		expr := pattern[len("re:"):]
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, 0, false, fmt.Errorf("invalid regex pattern %q: %v", expr, err)
+		}
+		return re.MatchString, literalPrefixLen(expr), false, nil
+	case strings.Contains(pattern, "*"):
+		re, err := regexp.Compile(globToRegexp(pattern))
+		if err != nil {
+			return nil, 0, false, fmt.Errorf("invalid glob pattern %q: %v", pattern, err)
+		}
+		// Everything before the first '*' is matched literally (globToRegexp quotes it).
+		return re.MatchString, strings.Index(pattern, "*"), false, nil
+	default:
+		prefix := pattern
+		return func(path string) bool { return strings.HasPrefix(path, prefix) }, len(prefix), true, nil
+	}
+}
+
+// maxDeltaTolerance bounds a `pattern = delta_tolerance` rule's value. Tolerances express how many
+// percentage points coverage is allowed to drop, so anything past this is almost certainly a typo
+// for a `pattern >= absolute_floor` rule (the two are easy to confuse for per-function patterns
+// like `pkg.Foo`, where `Foo=90` looks like it requires 90% coverage but actually permits a 90-point
+// drop from any baseline).
+const maxDeltaTolerance = 50
+
+// parseThreshold reads the threshold overrides file. Each non-comment line is either
+//
+//	pattern = delta_tolerance
+//
+// tolerating up to that percentage-point drop relative to baseline, or
+//
+//	pattern >= absolute_floor
+//
+// requiring at least that coverage regardless of baseline, including for functions/packages with
+// no baseline entry at all (new or renamed code). pattern may be a plain package/file prefix (the
+// original behavior), a glob using `*`/`**`, or a regular expression prefixed with `re:`. A line
+// ending in `!` is authoritative: once it matches, no further rule is considered for that path.
+func parseThreshold(thresholdFile string) ([]thresholdRule, error) {
+	f, err := os.Open(thresholdFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open threshold file, %s, %v", thresholdFile, err)
+	}
+	defer func() {
+		if err = f.Close(); err != nil {
+			glog.Errorf("failed to close file %s, %v", thresholdFile, err)
+		}
+	}()
+
+	scanner := bufio.NewScanner(f)
+	var rules []thresholdRule
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		authoritative := strings.HasSuffix(line, "!")
+		if authoritative {
+			line = strings.TrimSpace(strings.TrimSuffix(line, "!"))
+		}
+
+		kind := deltaTolerance
+		sep := "="
+		if idx := strings.Index(line, ">="); idx >= 0 {
+			kind = absoluteFloor
+			sep = ">="
+		}
+		idx := strings.Index(line, sep)
+		if idx < 0 {
+			// Not a recognized rule line; ignore it, as the original parser did.
+			continue
+		}
+		pattern := strings.TrimSpace(line[:idx])
+		valueStr := strings.TrimSpace(line[idx+len(sep):])
+
+		value, err := strconv.ParseFloat(valueStr, 64)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse threshold to float64 for pattern %s: %s, %v", pattern, valueStr, err)
+		}
+		if kind == deltaTolerance && value > maxDeltaTolerance {
+			return nil, fmt.Errorf("threshold for pattern %s tolerates an implausible %g-point coverage drop; "+
+				"use %s >= value if you meant to require a minimum coverage floor", pattern, value, pattern)
+		}
+		match, specificity, plain, err := compileRule(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("failed to compile threshold pattern %s: %v", pattern, err)
+		}
+
+		rules = append(rules, thresholdRule{
+			pattern:       pattern,
+			kind:          kind,
+			value:         value,
+			authoritative: authoritative,
+			specificity:   specificity,
+			match:         match,
+			plain:         plain,
+		})
+	}
+	return rules, scanner.Err()
+}
+
+// resolveRule returns the rule that governs path: the first authoritative match in declaration
+// order, or else the match with the longest literal prefix, ties broken by earlier declaration.
+func resolveRule(rules []thresholdRule, path string) *thresholdRule {
+	var best *thresholdRule
+	for i := range rules {
+		r := &rules[i]
+		if !r.match(path) {
+			continue
+		}
+		if r.authoritative {
+			return r
+		}
+		if best == nil || r.specificity > best.specificity {
+			best = r
+		}
+	}
+	return best
+}
+
+// resolveExactRule is like resolveRule, except a plain (non-glob, non-regex) pattern must equal
+// key exactly rather than merely prefix it. This is used for per-function lookups, where
+// "pkg.Foo" must not also match a sibling function "pkg.FooBar".
+func resolveExactRule(rules []thresholdRule, key string) *thresholdRule {
+	var best *thresholdRule
+	for i := range rules {
+		r := &rules[i]
+		matched := r.match(key)
+		if matched && r.plain {
+			matched = r.pattern == key
+		}
+		if !matched {
+			continue
+		}
+		if r.authoritative {
+			return r
+		}
+		if best == nil || r.specificity > best.specificity {
+			best = r
+		}
+	}
+	return best
+}
+
+// passesRule reports whether coverage (and its delta from baseline) satisfies rule. A nil rule
+// means no override applies, which preserves the original "any drop fails" default.
+func passesRule(rule *thresholdRule, delta, coverage float64) bool {
+	if rule == nil {
+		return delta >= 0
+	}
+	if rule.kind == absoluteFloor {
+		return coverage >= rule.value
+	}
+	return delta+rule.value >= 0
+}
+
+// describeRule renders the rule that fired, for diagnostics; a nil rule means the default applied.
+func describeRule(rule *thresholdRule) string {
+	if rule == nil {
+		return "<default, 0% tolerance>"
+	}
+	op := "="
+	if rule.kind == absoluteFloor {
+		op = ">="
+	}
+	return fmt.Sprintf("%s %s %g", rule.pattern, op, rule.value)
+}
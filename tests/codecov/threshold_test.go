@@ -0,0 +1,173 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeTempFile writes contents to a file under t.TempDir() and returns its path.
+func writeTempFile(t *testing.T, contents string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "thresholds")
+	if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatalf("failed to write temp file: %v", err)
+	}
+	return path
+}
+
+func TestCompileRule(t *testing.T) {
+	cases := []struct {
+		name    string
+		pattern string
+		match   string
+		noMatch string
+		plain   bool
+		wantErr bool
+	}{
+		{name: "plain prefix", pattern: "istio.io/istio/pilot", match: "istio.io/istio/pilot/pkg/foo.go", noMatch: "istio.io/istio/mixer/foo.go", plain: true},
+		{name: "glob star", pattern: "istio.io/istio/*/pkg", match: "istio.io/istio/pilot/pkg", noMatch: "istio.io/istio/pilot/pkg/foo"},
+		{name: "glob double star", pattern: "istio.io/istio/**/foo.go", match: "istio.io/istio/pilot/pkg/foo.go", noMatch: "istio.io/istio/pilot/pkg/bar.go"},
+		{name: "regex", pattern: "re:^istio\\.io/istio/(pilot|mixer)/", match: "istio.io/istio/pilot/pkg/foo.go", noMatch: "istio.io/istio/galley/foo.go"},
+		{name: "invalid regex", pattern: "re:(", wantErr: true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			match, _, plain, err := compileRule(c.pattern)
+			if c.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if plain != c.plain {
+				t.Errorf("plain = %v, want %v", plain, c.plain)
+			}
+			if !match(c.match) {
+				t.Errorf("expected pattern %q to match %q", c.pattern, c.match)
+			}
+			if match(c.noMatch) {
+				t.Errorf("expected pattern %q not to match %q", c.pattern, c.noMatch)
+			}
+		})
+	}
+}
+
+func mustRule(t *testing.T, pattern string, kind ruleKind, value float64, authoritative bool) thresholdRule {
+	t.Helper()
+	match, specificity, plain, err := compileRule(pattern)
+	if err != nil {
+		t.Fatalf("failed to compile pattern %q: %v", pattern, err)
+	}
+	return thresholdRule{
+		pattern:       pattern,
+		kind:          kind,
+		value:         value,
+		authoritative: authoritative,
+		specificity:   specificity,
+		match:         match,
+		plain:         plain,
+	}
+}
+
+func TestResolveRulePrecedence(t *testing.T) {
+	rules := []thresholdRule{
+		mustRule(t, "istio.io/istio", deltaTolerance, -5, false),
+		mustRule(t, "istio.io/istio/pilot", deltaTolerance, -1, false),
+		mustRule(t, "istio.io/istio/pilot/pkg/config", absoluteFloor, 90, false),
+	}
+
+	cases := []struct {
+		name string
+		path string
+		want string // pattern of the expected winning rule, "" for none
+	}{
+		{name: "most specific prefix wins", path: "istio.io/istio/pilot/pkg/config/foo.go", want: "istio.io/istio/pilot/pkg/config"},
+		{name: "falls back to less specific prefix", path: "istio.io/istio/pilot/pkg/other/foo.go", want: "istio.io/istio/pilot"},
+		{name: "falls back to root rule", path: "istio.io/istio/mixer/foo.go", want: "istio.io/istio"},
+		{name: "no match", path: "k8s.io/api/core/foo.go", want: ""},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got := resolveRule(rules, c.path)
+			if c.want == "" {
+				if got != nil {
+					t.Fatalf("expected no rule, got %s", got.pattern)
+				}
+				return
+			}
+			if got == nil || got.pattern != c.want {
+				t.Fatalf("resolveRule(%s) = %v, want pattern %s", c.path, got, c.want)
+			}
+		})
+	}
+}
+
+func TestResolveRuleAuthoritativeShortCircuits(t *testing.T) {
+	rules := []thresholdRule{
+		mustRule(t, "istio.io/istio/pilot/pkg/config", absoluteFloor, 0, true),
+		mustRule(t, "istio.io/istio/pilot", deltaTolerance, -5, false),
+	}
+	got := resolveRule(rules, "istio.io/istio/pilot/pkg/config/foo.go")
+	if got == nil || got.pattern != "istio.io/istio/pilot/pkg/config" {
+		t.Fatalf("expected the authoritative rule to win, got %v", got)
+	}
+}
+
+func TestResolveExactRulePlainPatternsRequireExactMatch(t *testing.T) {
+	rules := []thresholdRule{
+		mustRule(t, "istio.io/istio/pilot.Foo", deltaTolerance, -5, false),
+	}
+	if got := resolveExactRule(rules, "istio.io/istio/pilot.Foo"); got == nil {
+		t.Fatalf("expected an exact match to resolve")
+	}
+	if got := resolveExactRule(rules, "istio.io/istio/pilot.FooBar"); got != nil {
+		t.Fatalf("plain pattern %q should not match %q, got %v", rules[0].pattern, "istio.io/istio/pilot.FooBar", got)
+	}
+}
+
+func TestResolveExactRuleGlobPatternsStillMatchByRegexp(t *testing.T) {
+	rules := []thresholdRule{
+		mustRule(t, "istio.io/istio/pilot.Foo*", deltaTolerance, -5, false),
+	}
+	if got := resolveExactRule(rules, "istio.io/istio/pilot.FooBar"); got == nil {
+		t.Fatalf("expected glob pattern %q to match %q", rules[0].pattern, "istio.io/istio/pilot.FooBar")
+	}
+}
+
+func TestParseThresholdRejectsImplausibleDeltaTolerance(t *testing.T) {
+	f := writeTempFile(t, "istio.io/istio/pilot/pkg/config.Foo=90\n")
+	if _, err := parseThreshold(f); err == nil {
+		t.Fatalf("expected an error for a delta tolerance of 90, got none")
+	}
+}
+
+func TestParseThresholdAllowsFloorOfSameMagnitude(t *testing.T) {
+	f := writeTempFile(t, "istio.io/istio/pilot/pkg/config.Foo >= 90\n")
+	rules, err := parseThreshold(f)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(rules) != 1 || rules[0].kind != absoluteFloor || rules[0].value != 90 {
+		t.Fatalf("got %+v, want a single absoluteFloor rule of 90", rules)
+	}
+}